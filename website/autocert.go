@@ -0,0 +1,67 @@
+/*
+Copyright 2014 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// autocertManager returns an autocert.Manager that obtains and
+// renews certificates from Let's Encrypt for the given whitelist of
+// hosts, caching them under cacheDir.
+func autocertManager(cacheDir string, hosts []string) *autocert.Manager {
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(hosts...),
+		Cache:      autocert.DirCache(cacheDir),
+	}
+}
+
+// httpChallengeRedirect returns a handler for the plain HTTP listener
+// when -autocert is in use: ACME http-01 challenge requests are
+// served and everything else is 301-redirected to the HTTPS version
+// of the same URL. It always delegates to the ACME manager currently
+// installed on s (mirroring acmeGetCertificate), rather than
+// capturing one manager at listener-start time, so a SIGHUP reload
+// that replaces the manager without restarting the listeners doesn't
+// leave the HTTP side answering challenges from a stale manager.
+func httpChallengeRedirect(s *server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/.well-known/acme-challenge/") {
+			if m := s.currentAcmeManager(); m != nil {
+				m.HTTPHandler(nil).ServeHTTP(w, r)
+				return
+			}
+		}
+		target := "https://" + r.Host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+	})
+}
+
+// hstsHandler wraps h, adding a Strict-Transport-Security response
+// header to every request. It's meant for the HTTPS handler chain
+// when -autocert is in use.
+func hstsHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", "max-age=31536000; includeSubDomains; preload")
+		h.ServeHTTP(w, r)
+	})
+}
+
@@ -33,34 +33,56 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"camlistore.org/website/gitbackend"
+	"camlistore.org/website/staticfs"
 )
 
 const defaultAddr = ":31798" // default webserver address
 
 var h1TitlePattern = regexp.MustCompile(`<h1>([^<]+)</h1>`)
 
+// rsyncOnce ensures the Gerrit mirror loop started by buildHandler is
+// only ever spawned once per process, even though buildHandler itself
+// runs again on every config reload.
+var rsyncOnce sync.Once
+
 var (
-	httpAddr            = flag.String("http", defaultAddr, "HTTP service address (e.g., '"+defaultAddr+"')")
-	httpsAddr           = flag.String("https", "", "HTTPS service address")
-	root                = flag.String("root", "", "Website root (parent of 'static', 'content', and 'tmpl")
-	gitwebScript        = flag.String("gitwebscript", "/usr/lib/cgi-bin/gitweb.cgi", "Path to gitweb.cgi, or blank to disable.")
-	gitwebFiles         = flag.String("gitwebfiles", "/usr/share/gitweb/static", "Path to gitweb's static files.")
-	logDir              = flag.String("logdir", "", "Directory to write log files to (one per hour), or empty to not log.")
-	logStdout           = flag.Bool("logstdout", true, "Write to stdout?")
-	tlsCertFile         = flag.String("tlscert", "", "TLS cert file")
-	tlsKeyFile          = flag.String("tlskey", "", "TLS private key file")
-	gerritUser          = flag.String("gerrituser", "ubuntu", "Gerrit host's username")
-	gerritHost          = flag.String("gerrithost", "", "Gerrit host, or empty.")
-	buildbotBackend     = flag.String("buildbot_backend", "", "Build bot status backend URL")
-	buildbotHost        = flag.String("buildbot_host", "", "Hostname to map to the buildbot_backend. If an HTTP request with this hostname is received, it proxies to buildbot_backend.")
-	pageHtml, errorHtml *template.Template
+	httpAddr         = flag.String("http", defaultAddr, "HTTP service address (e.g., '"+defaultAddr+"')")
+	httpsAddr        = flag.String("https", "", "HTTPS service address")
+	root             = flag.String("root", "", "Website root (parent of 'static', 'content', and 'tmpl")
+	gitDir           = flag.String("gitdir", "", "Parent directory of the bare git repositories served at /code/. If blank, /code/ serves the rsync'd Gerrit mirror when -gerrithost is set and is disabled otherwise.")
+	logDir           = flag.String("logdir", "", "Directory to write log files to (one per hour), or empty to not log.")
+	logStdout        = flag.Bool("logstdout", true, "Write to stdout?")
+	tlsCertFile      = flag.String("tlscert", "", "TLS cert file")
+	tlsKeyFile       = flag.String("tlskey", "", "TLS private key file")
+	autocertHosts    = flag.String("autocert", "", "Comma-separated list of hostnames to automatically obtain TLS certificates for via Let's Encrypt, or blank to disable. Takes precedence over -tlscert/-tlskey.")
+	autocertCacheDir = flag.String("autocertcache", "autocert-cache", "Directory to cache Let's Encrypt certificates in, relative to -root unless absolute.")
+	gerritUser       = flag.String("gerrituser", "ubuntu", "Gerrit host's username")
+	gerritHost       = flag.String("gerrithost", "", "Gerrit host, or empty.")
+	buildbotBackend  = flag.String("buildbot_backend", "", "Build bot status backend URL")
+	buildbotHost     = flag.String("buildbot_host", "", "Hostname to map to the buildbot_backend. If an HTTP request with this hostname is received, it proxies to buildbot_backend.")
+	middlewareConf   = flag.String("middlewareconf", "", "Path to a JSON file declaring per-route auth/IP/rate-limit middleware, or blank to use defaults.")
+	configFile       = flag.String("config", "", "Path to a YAML config file covering listeners, TLS, gerrit/git settings, logging, and middleware; any flag passed explicitly overrides the corresponding setting. Blank to configure from flags alone.")
+	devMode          = flag.Bool("dev", false, "Run in development mode: watch templates and static assets and reload them on change, instead of only scanning once at startup.")
+	assets           = staticfs.New()
 )
 
 var fmap = template.FuncMap{
 	"":        textFmt,
 	"html":    htmlFmt,
 	"htmlesc": htmlEscFmt,
+	"asset":   assetURL,
+}
+
+// assetURL is the "{{asset "css/site.css"}}" template helper: it
+// rewrites a path relative to the static root to its fingerprinted
+// URL under /static/.
+func assetURL(path string) string {
+	return assets.AssetURL("/static/" + path)
 }
 
 // Template formatter for "" (default) format.
@@ -119,41 +141,76 @@ func applyTemplate(t *template.Template, name string, data interface{}) []byte {
 }
 
 func servePage(w http.ResponseWriter, title, subtitle string, content []byte) {
+	servePageTOC(w, title, subtitle, content, nil)
+}
+
+// servePageTOC is servePage plus a table of contents, for callers
+// (currently just serveMarkdown) that have one to offer; tmpl/page.html
+// ranges over .TOC to render it when non-empty.
+func servePageTOC(w http.ResponseWriter, title, subtitle string, content []byte, toc []tocEntry) {
 	d := struct {
 		Title    string
 		Subtitle string
 		Content  template.HTML
+		TOC      []tocEntry
 	}{
 		title,
 		subtitle,
 		template.HTML(content),
+		toc,
 	}
 
-	if err := pageHtml.Execute(w, &d); err != nil {
+	if err := pageTemplates().page.Execute(w, &d); err != nil {
 		log.Printf("godocHTML.Execute: %s", err)
 	}
 }
 
-func readTemplate(name string) *template.Template {
+func readTemplate(name string) (*template.Template, error) {
 	fileName := filepath.Join(*root, "tmpl", name)
 	data, err := ioutil.ReadFile(fileName)
 	if err != nil {
-		log.Fatalf("ReadFile %s: %v", fileName, err)
+		return nil, fmt.Errorf("ReadFile %s: %v", fileName, err)
 	}
 	t, err := template.New(name).Funcs(fmap).Parse(string(data))
 	if err != nil {
-		log.Fatalf("%s: %v", fileName, err)
+		return nil, fmt.Errorf("%s: %v", fileName, err)
 	}
-	return t
+	return t, nil
+}
+
+// templateSet is the page/error templates as a unit, so a reload
+// swaps both atomically and a request never sees one from before the
+// reload paired with one from after it.
+type templateSet struct {
+	page  *template.Template
+	error *template.Template
+}
+
+var templates atomic.Value // *templateSet
+
+func pageTemplates() *templateSet {
+	return templates.Load().(*templateSet)
 }
 
-func readTemplates() {
-	pageHtml = readTemplate("page.html")
-	errorHtml = readTemplate("error.html")
+// readTemplates parses page.html and error.html and atomically
+// installs them as the current templateSet. It's called once at
+// startup (where a parse failure is fatal) and again on every SIGHUP
+// (where it isn't: a bad edit just keeps the previous templates).
+func readTemplates() error {
+	page, err := readTemplate("page.html")
+	if err != nil {
+		return err
+	}
+	errT, err := readTemplate("error.html")
+	if err != nil {
+		return err
+	}
+	templates.Store(&templateSet{page: page, error: errT})
+	return nil
 }
 
 func serveError(w http.ResponseWriter, r *http.Request, relpath string, err error) {
-	contents := applyTemplate(errorHtml, "errorHtml", err) // err may contain an absolute path!
+	contents := applyTemplate(pageTemplates().error, "errorHtml", err) // err may contain an absolute path!
 	w.WriteHeader(http.StatusNotFound)
 	servePage(w, "File "+relpath, "", contents)
 }
@@ -170,30 +227,70 @@ func mainHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	absPath := filepath.Join(*root, "content", relPath)
+	contentDir := filepath.Join(*root, "content")
+	absPath := filepath.Join(contentDir, relPath)
 	fi, err := os.Lstat(absPath)
 	if err != nil {
-		log.Print(err)
+		log.Printf("[%s] %v", requestIDFromContext(req.Context()), err)
 		serveError(rw, req, relPath, err)
 		return
 	}
 	if fi.IsDir() {
-		relPath += "/index.html"
-		absPath = filepath.Join(*root, "content", relPath)
-		fi, err = os.Lstat(absPath)
-		if err != nil {
-			log.Print(err)
-			serveError(rw, req, relPath, err)
+		indexPath, ok := findIndex(absPath)
+		if !ok {
+			serveDirIndex(rw, req, relPath, absPath)
 			return
 		}
+		relPath, absPath = filepath.Join(relPath, filepath.Base(indexPath)), indexPath
 	}
 
-	switch {
-	case !fi.IsDir():
+	switch filepath.Ext(absPath) {
+	case ".md":
+		data, err := ioutil.ReadFile(absPath)
+		if err != nil {
+			serveError(rw, req, absPath, err)
+			return
+		}
+		serveMarkdown(rw, req, relPath, data)
+	default:
 		serveFile(rw, req, relPath, absPath)
 	}
 }
 
+// findIndex looks for index.md then index.html inside dir, returning
+// the one found (if any).
+func findIndex(dir string) (path string, ok bool) {
+	for _, name := range []string{"index.md", "index.html"} {
+		p := filepath.Join(dir, name)
+		if fi, err := os.Lstat(p); err == nil && !fi.IsDir() {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// serveDirIndex renders a simple listing of the subdirectories and
+// .md/.html files in absDir, for directories lacking an index.{md,html}.
+func serveDirIndex(rw http.ResponseWriter, req *http.Request, relPath, absDir string) {
+	entries, err := ioutil.ReadDir(absDir)
+	if err != nil {
+		serveError(rw, req, relPath, err)
+		return
+	}
+	var buf bytes.Buffer
+	fmt.Fprint(&buf, "<ul>")
+	for _, e := range entries {
+		name := e.Name()
+		if !e.IsDir() && filepath.Ext(name) != ".md" && filepath.Ext(name) != ".html" {
+			continue
+		}
+		escaped := template.HTMLEscapeString(name)
+		fmt.Fprintf(&buf, `<li><a href="%s">%s</a></li>`, escaped, escaped)
+	}
+	fmt.Fprint(&buf, "</ul>")
+	servePage(rw, relPath, "", buf.Bytes())
+}
+
 func serveFile(rw http.ResponseWriter, req *http.Request, relPath, absPath string) {
 	data, err := ioutil.ReadFile(absPath)
 	if err != nil {
@@ -209,39 +306,11 @@ func serveFile(rw http.ResponseWriter, req *http.Request, relPath, absPath strin
 	servePage(rw, title, "", data)
 }
 
-type gitwebHandler struct {
-	Cgi    http.Handler
-	Static http.Handler
-}
-
-func (h *gitwebHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
-	if r.URL.Path == "/code/" ||
-		strings.HasPrefix(r.URL.Path, "/code/?") {
-		h.Cgi.ServeHTTP(rw, r)
-	} else {
-		h.Static.ServeHTTP(rw, r)
-	}
-}
-
-func isBot(r *http.Request) bool {
-	agent := r.Header.Get("User-Agent")
-	return strings.Contains(agent, "Baidu") || strings.Contains(agent, "bingbot") ||
-		strings.Contains(agent, "Ezooms") || strings.Contains(agent, "Googlebot")
-}
-
 type noWwwHandler struct {
 	Handler http.Handler
 }
 
 func (h *noWwwHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
-	// Some bots (especially Baidu) don't seem to respect robots.txt and swamp gitweb.cgi,
-	// so explicitly protect it from bots.
-	if ru := r.URL.RequestURI(); strings.Contains(ru, "/code/") && strings.Contains(ru, "?") && isBot(r) {
-		http.Error(rw, "bye", http.StatusUnauthorized)
-		log.Printf("bot denied")
-		return
-	}
-
 	host := strings.ToLower(r.Host)
 	if host == "www.camlistore.org" {
 		http.Redirect(rw, r, "http://camlistore.org"+r.URL.RequestURI(), http.StatusFound)
@@ -250,47 +319,52 @@ func (h *noWwwHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	h.Handler.ServeHTTP(rw, r)
 }
 
-func fixupGitwebFiles() {
-	fi, err := os.Stat(*gitwebFiles)
-	if err != nil || !fi.IsDir() {
-		if *gitwebFiles == "/usr/share/gitweb/static" {
-			// Old Debian/Ubuntu location
-			*gitwebFiles = "/usr/share/gitweb"
-		}
-	}
-}
-
-func main() {
-	flag.Parse()
-	readTemplates()
-
-	if *root == "" {
+// buildHandler constructs the full root http.Handler (mux, gerrit
+// proxy, gitbackend, middleware, bot policy, and access logging) from
+// cfg. It's called once at startup and again on every config reload.
+func buildHandler(cfg *Config) (http.Handler, error) {
+	var mwConf *middlewareConfig
+	if cfg.MiddlewareConf != "" {
 		var err error
-		*root, err = os.Getwd()
+		mwConf, err = loadMiddlewareConfig(cfg.MiddlewareConf)
 		if err != nil {
-			log.Fatalf("Failed to getwd: %v", err)
+			return nil, err
 		}
 	}
 
-	fixupGitwebFiles()
-
-	latestGits := filepath.Join(*root, "latestgits")
+	latestGits := filepath.Join(cfg.Root, "latestgits")
 	os.Mkdir(latestGits, 0700)
-	if *gerritHost != "" {
-		go rsyncFromGerrit(latestGits)
+	if cfg.GerritHost != "" {
+		// buildHandler runs again on every SIGHUP reload; guard with
+		// rsyncOnce so each reload doesn't pile on another
+		// concurrent, never-exiting rsync loop.
+		rsyncOnce.Do(func() {
+			go rsyncFromGerrit(cfg.GerritUser, cfg.GerritHost, latestGits)
+		})
 	}
 
-	mux := http.DefaultServeMux
-	mux.Handle("/favicon.ico", http.FileServer(http.Dir(filepath.Join(*root, "static"))))
-	mux.Handle("/robots.txt", http.FileServer(http.Dir(filepath.Join(*root, "static"))))
-	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir(filepath.Join(*root, "static")))))
-	mux.Handle("/talks/", http.StripPrefix("/talks/", http.FileServer(http.Dir(filepath.Join(*root, "talks")))))
+	assets.Dev = cfg.Dev
+	if err := assets.Mount("/static/", filepath.Join(cfg.Root, "static")); err != nil {
+		return nil, fmt.Errorf("mounting static assets: %v", err)
+	}
+	if err := assets.Mount("/talks/", filepath.Join(cfg.Root, "talks")); err != nil {
+		return nil, fmt.Errorf("mounting talks assets: %v", err)
+	}
+	if cfg.Dev {
+		go watchTemplates(filepath.Join(cfg.Root, "tmpl"))
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/favicon.ico", staticfs.Rewrite(assets, "/static/favicon.ico"))
+	mux.Handle("/robots.txt", staticfs.Rewrite(assets, "/static/robots.txt"))
+	mux.Handle("/static/", assets)
+	mux.Handle("/talks/", assets)
 	mux.Handle("/pkg/", godocHandler{})
 	mux.Handle("/cmd/", godocHandler{})
 
-	gerritUrl, _ := url.Parse(fmt.Sprintf("http://%s:8000/", *gerritHost))
+	gerritUrl, _ := url.Parse(fmt.Sprintf("http://%s:8000/", cfg.GerritHost))
 	var gerritHandler http.Handler = httputil.NewSingleHostReverseProxy(gerritUrl)
-	if *httpsAddr != "" {
+	if cfg.HTTPSAddr != "" {
 		proxyHandler := gerritHandler
 		gerritHandler = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 			if req.TLS != nil {
@@ -300,70 +374,95 @@ func main() {
 			http.Redirect(rw, req, "https://camlistore.org"+req.URL.RequestURI(), http.StatusFound)
 		})
 	}
-	mux.Handle("/r/", gerritHandler)
-	mux.HandleFunc("/debugz/ip", ipHandler)
+	if err := mwConf.handle(mux, "/r/", gerritHandler); err != nil {
+		return nil, err
+	}
+	if err := mwConf.handle(mux, "/debugz/ip", http.HandlerFunc(ipHandler)); err != nil {
+		return nil, err
+	}
+	if err := mwConf.handle(mux, "/metrics", metricsHandler()); err != nil {
+		return nil, err
+	}
 
-	testCgi := &cgi.Handler{Path: filepath.Join(*root, "test.cgi"),
+	testCgi := &cgi.Handler{Path: filepath.Join(cfg.Root, "test.cgi"),
 		Root: "/test.cgi",
 	}
 	mux.Handle("/test.cgi", testCgi)
 	mux.Handle("/test.cgi/foo", testCgi)
 	mux.Handle("/code", http.RedirectHandler("/code/", http.StatusFound))
-	if *gitwebScript != "" {
-		env := os.Environ()
-		env = append(env, "GITWEB_CONFIG="+filepath.Join(*root, "gitweb-camli.conf"))
-		env = append(env, "CAMWEB_ROOT="+filepath.Join(*root))
-		env = append(env, "CAMWEB_GITDIR="+latestGits)
-		mux.Handle("/code/", &fixUpGitwebUrls{&gitwebHandler{
-			Cgi: &cgi.Handler{
-				Path: *gitwebScript,
-				Root: "/code/",
-				Env:  env,
-			},
-			Static: http.StripPrefix("/code/", http.FileServer(http.Dir(*gitwebFiles))),
-		}})
+	if cfg.GitDir != "" {
+		err := mwConf.handle(mux, "/code/", http.StripPrefix("/code/", &gitbackend.Server{
+			Dir:  cfg.GitDir,
+			CORS: true,
+		}))
+		if err != nil {
+			return nil, err
+		}
+	} else if cfg.GerritHost != "" {
+		// No local git mirror configured; fall back to mirroring
+		// from Gerrit as before.
+		err := mwConf.handle(mux, "/code/", http.StripPrefix("/code/", &gitbackend.Server{
+			Dir:  latestGits,
+			CORS: true,
+		}))
+		if err != nil {
+			return nil, err
+		}
 	}
 	mux.HandleFunc("/issue/", issueRedirect)
 	mux.HandleFunc("/", mainHandler)
 
-	if *buildbotHost != "" && *buildbotBackend != "" {
-		buildbotUrl, err := url.Parse(*buildbotBackend)
+	if cfg.BuildbotHost != "" && cfg.BuildbotBackend != "" {
+		buildbotUrl, err := url.Parse(cfg.BuildbotBackend)
 		if err != nil {
-			log.Fatalf("Failed to parse %v as a URL: %v", *buildbotBackend, err)
+			return nil, fmt.Errorf("failed to parse %v as a URL: %v", cfg.BuildbotBackend, err)
 		}
 		buildbotHandler := httputil.NewSingleHostReverseProxy(buildbotUrl)
-		bbhpattern := strings.TrimRight(*buildbotHost, "/") + "/"
+		bbhpattern := strings.TrimRight(cfg.BuildbotHost, "/") + "/"
 		mux.Handle(bbhpattern, buildbotHandler)
 	}
 
-	var handler http.Handler = &noWwwHandler{Handler: mux}
-	if *logDir != "" || *logStdout {
-		handler = NewLoggingHandler(handler, *logDir, *logStdout)
+	botMw, err := mwConf.botMiddleware()
+	if err != nil {
+		return nil, err
+	}
+	var handler http.Handler = chain(&noWwwHandler{Handler: mux}, botMw)
+	handler = metricsMiddleware(handler)
+	if cfg.LogDir != "" || cfg.LogStdout {
+		handler = NewLoggingHandler(handler, cfg.LogDir, cfg.LogStdout)
 	}
+	return handler, nil
+}
 
-	errch := make(chan error)
+func main() {
+	flag.Parse()
+	if err := readTemplates(); err != nil {
+		log.Fatalf("parsing templates: %v", err)
+	}
+
+	if *root == "" {
+		var err error
+		*root, err = os.Getwd()
+		if err != nil {
+			log.Fatalf("Failed to getwd: %v", err)
+		}
+	}
 
-	httpServer := &http.Server{
-		Addr:         *httpAddr,
-		Handler:      handler,
-		ReadTimeout:  5 * time.Minute,
-		WriteTimeout: 30 * time.Minute,
+	cfg, err := currentConfig()
+	if err != nil {
+		log.Fatalf("loading config: %v", err)
+	}
+	if cfg.Root == "" {
+		cfg.Root = *root
 	}
-	go func() {
-		errch <- httpServer.ListenAndServe()
-	}()
 
-	if *httpsAddr != "" {
-		log.Printf("Starting TLS server on %s", *httpsAddr)
-		httpsServer := new(http.Server)
-		*httpsServer = *httpServer
-		httpsServer.Addr = *httpsAddr
-		go func() {
-			errch <- httpsServer.ListenAndServeTLS(*tlsCertFile, *tlsKeyFile)
-		}()
+	srv := newServer()
+	if err := srv.reload(cfg); err != nil {
+		log.Fatalf("starting server: %v", err)
 	}
+	go srv.watchSIGHUP()
 
-	log.Fatalf("Serve error: %v", <-errch)
+	log.Fatalf("Serve error: %v", <-srv.errc)
 }
 
 var issueNum = regexp.MustCompile(`^/issue/(\d+)$`)
@@ -377,30 +476,9 @@ func issueRedirect(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "https://code.google.com/p/camlistore/issues/detail?id="+m[1], http.StatusFound)
 }
 
-type fixUpGitwebUrls struct {
-	handler http.Handler
-}
-
-// Not sure what's making these broken URLs like:
-//
-//   http://localhost:8080/code/?p=camlistore.git%3Bf=doc/json-signing/json-signing.txt%3Bhb=master
-//
-// ... but something is.  Maybe Buzz?  For now just re-write them
-// . Doesn't seem to be a bug in the CGI implementation, though, which
-// is what I'd originally suspected.
-func (fu *fixUpGitwebUrls) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	oldUrl := req.URL.String()
-	newUrl := strings.Replace(oldUrl, "%3B", ";", -1)
-	if newUrl == oldUrl {
-		fu.handler.ServeHTTP(rw, req)
-		return
-	}
-	http.Redirect(rw, req, newUrl, http.StatusFound)
-}
-
-func rsyncFromGerrit(dest string) {
+func rsyncFromGerrit(user, host, dest string) {
 	for {
-		err := exec.Command("rsync", "-avPW", *gerritUser+"@"+*gerritHost+":gerrit/git/", dest+"/").Run()
+		err := exec.Command("rsync", "-avPW", user+"@"+host+":gerrit/git/", dest+"/").Run()
 		if err != nil {
 			log.Printf("rsync from gerrit = %v", err)
 		}
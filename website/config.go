@@ -0,0 +1,168 @@
+/*
+Copyright 2014 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the typed, on-disk description of a camweb deployment. It
+// is loaded from YAML via -config; any flag the operator passes
+// explicitly on the command line overrides the corresponding field,
+// so a bare "camweb -config=camweb.yaml" and the historical
+// flag-only invocation both keep working.
+type Config struct {
+	HTTPAddr  string `yaml:"httpAddr"`
+	HTTPSAddr string `yaml:"httpsAddr"`
+	Root      string `yaml:"root"`
+
+	TLSCertFile      string   `yaml:"tlsCertFile"`
+	TLSKeyFile       string   `yaml:"tlsKeyFile"`
+	AutocertHosts    []string `yaml:"autocertHosts"`
+	AutocertCacheDir string   `yaml:"autocertCacheDir"`
+
+	GitDir string `yaml:"gitDir"`
+
+	GerritUser string `yaml:"gerritUser"`
+	GerritHost string `yaml:"gerritHost"`
+
+	BuildbotBackend string `yaml:"buildbotBackend"`
+	BuildbotHost    string `yaml:"buildbotHost"`
+
+	LogDir    string `yaml:"logDir"`
+	LogStdout bool   `yaml:"logStdout"`
+
+	MiddlewareConf string `yaml:"middlewareConf"`
+
+	Dev bool `yaml:"dev"`
+}
+
+// loadConfig parses a Config from the YAML file at path. Fields the
+// file leaves unset keep their flag values (see configFromFlags).
+func loadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := configFromFlags()
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// configFromFlags builds a Config purely from the current flag
+// values; it's the fallback when -config is unset, and it also
+// supplies the defaults that an explicitly-set flag overrides on top
+// of a loaded file (see applyFlagOverrides).
+func configFromFlags() *Config {
+	return &Config{
+		HTTPAddr:         *httpAddr,
+		HTTPSAddr:        *httpsAddr,
+		Root:             *root,
+		TLSCertFile:      *tlsCertFile,
+		TLSKeyFile:       *tlsKeyFile,
+		AutocertHosts:    splitNonEmpty(*autocertHosts, ","),
+		AutocertCacheDir: *autocertCacheDir,
+		GitDir:           *gitDir,
+		GerritUser:       *gerritUser,
+		GerritHost:       *gerritHost,
+		BuildbotBackend:  *buildbotBackend,
+		BuildbotHost:     *buildbotHost,
+		LogDir:           *logDir,
+		LogStdout:        *logStdout,
+		MiddlewareConf:   *middlewareConf,
+		Dev:              *devMode,
+	}
+}
+
+// applyFlagOverrides mutates cfg in place, replacing any field whose
+// corresponding flag was explicitly passed on the command line with
+// that flag's value. It's how "-config=base.yaml -gerrithost=foo"
+// lets a single flag win over the file.
+func applyFlagOverrides(cfg *Config) {
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "http":
+			cfg.HTTPAddr = *httpAddr
+		case "https":
+			cfg.HTTPSAddr = *httpsAddr
+		case "root":
+			cfg.Root = *root
+		case "tlscert":
+			cfg.TLSCertFile = *tlsCertFile
+		case "tlskey":
+			cfg.TLSKeyFile = *tlsKeyFile
+		case "autocert":
+			cfg.AutocertHosts = splitNonEmpty(*autocertHosts, ",")
+		case "autocertcache":
+			cfg.AutocertCacheDir = *autocertCacheDir
+		case "gitdir":
+			cfg.GitDir = *gitDir
+		case "gerrituser":
+			cfg.GerritUser = *gerritUser
+		case "gerrithost":
+			cfg.GerritHost = *gerritHost
+		case "buildbot_backend":
+			cfg.BuildbotBackend = *buildbotBackend
+		case "buildbot_host":
+			cfg.BuildbotHost = *buildbotHost
+		case "logdir":
+			cfg.LogDir = *logDir
+		case "logstdout":
+			cfg.LogStdout = *logStdout
+		case "middlewareconf":
+			cfg.MiddlewareConf = *middlewareConf
+		case "dev":
+			cfg.Dev = *devMode
+		}
+	})
+}
+
+// currentConfig re-derives a Config the same way main() does at
+// startup: from -config plus any flag overrides, or from flags alone
+// when -config is unset. It's called again on every SIGHUP so a
+// reload picks up edits to either the flags (via a supervisor
+// restart) or, far more commonly, the config file on disk.
+func currentConfig() (*Config, error) {
+	if *configFile == "" {
+		return configFromFlags(), nil
+	}
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		return nil, err
+	}
+	applyFlagOverrides(cfg)
+	return cfg, nil
+}
+
+func splitNonEmpty(s, sep string) []string {
+	if s == "" {
+		return nil
+	}
+	var out []string
+	for _, p := range strings.Split(s, sep) {
+		if p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
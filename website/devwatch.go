@@ -0,0 +1,44 @@
+/*
+Copyright 2014 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"log"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchTemplates re-parses the page/error templates whenever a file
+// under dir changes. It's only started in -dev mode; the static
+// asset pipeline watches its own directories via staticfs.FS.Dev.
+func watchTemplates(dir string) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("devwatch: %v", err)
+		return
+	}
+	if err := w.Add(dir); err != nil {
+		log.Printf("devwatch: watching %s: %v", dir, err)
+		return
+	}
+	for range w.Events {
+		log.Printf("devwatch: reloading templates")
+		if err := readTemplates(); err != nil {
+			log.Printf("devwatch: reloading templates: %v", err)
+		}
+	}
+}
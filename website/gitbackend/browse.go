@@ -0,0 +1,116 @@
+/*
+Copyright 2014 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitbackend
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"net/http"
+	"os/exec"
+	"strings"
+)
+
+// serveBrowse renders a minimal HTML view of a repository's tree,
+// blob, commit or log, based on the trailing path component after
+// the repo name (e.g. /camlistore.git/log, /camlistore.git/tree/master).
+func (s *Server) serveBrowse(w http.ResponseWriter, r *http.Request, path string) {
+	repo, view := splitRepoView(path)
+	if repo == "" {
+		http.NotFound(w, r)
+		return
+	}
+	dir := s.repoDir(repo)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	escaped := html.EscapeString(repo)
+	fmt.Fprintf(w, "<html><head><title>%s</title></head><body><h1>%s</h1>", escaped, escaped)
+	defer fmt.Fprint(w, "</body></html>")
+
+	switch {
+	case view == "" || view == "log":
+		s.writeLog(w, dir)
+	case strings.HasPrefix(view, "commit/"):
+		s.writeCommit(w, dir, strings.TrimPrefix(view, "commit/"))
+	case strings.HasPrefix(view, "tree/"):
+		s.writeTree(w, dir, strings.TrimPrefix(view, "tree/"))
+	case strings.HasPrefix(view, "blob/"):
+		s.writeBlob(w, dir, strings.TrimPrefix(view, "blob/"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func splitRepoView(path string) (repo, view string) {
+	path = strings.Trim(path, "/")
+	i := strings.Index(path, ".git")
+	if i < 0 {
+		return "", ""
+	}
+	repo = path[:i]
+	view = strings.TrimPrefix(path[i+len(".git"):], "/")
+	return repo, view
+}
+
+func (s *Server) writeLog(w http.ResponseWriter, dir string) {
+	out, err := exec.Command(s.gitBinary(), "--git-dir", dir, "log", "-n", "50", "--pretty=format:%H %an %s").Output()
+	if err != nil {
+		fmt.Fprintf(w, "<p>error: %s</p>", err)
+		return
+	}
+	fmt.Fprint(w, "<pre>")
+	template.HTMLEscape(w, out)
+	fmt.Fprint(w, "</pre>")
+}
+
+func (s *Server) writeCommit(w http.ResponseWriter, dir, hash string) {
+	out, err := exec.Command(s.gitBinary(), "--git-dir", dir, "show", "--end-of-options", hash).Output()
+	if err != nil {
+		fmt.Fprintf(w, "<p>error: %s</p>", err)
+		return
+	}
+	fmt.Fprint(w, "<pre>")
+	template.HTMLEscape(w, out)
+	fmt.Fprint(w, "</pre>")
+}
+
+func (s *Server) writeTree(w http.ResponseWriter, dir, ref string) {
+	out, err := exec.Command(s.gitBinary(), "--git-dir", dir, "ls-tree", "--name-only", "--", ref).Output()
+	if err != nil {
+		fmt.Fprintf(w, "<p>error: %s</p>", err)
+		return
+	}
+	fmt.Fprint(w, "<ul>")
+	for _, name := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if name == "" {
+			continue
+		}
+		fmt.Fprintf(w, "<li>%s</li>", html.EscapeString(name))
+	}
+	fmt.Fprint(w, "</ul>")
+}
+
+func (s *Server) writeBlob(w http.ResponseWriter, dir, ref string) {
+	out, err := exec.Command(s.gitBinary(), "--git-dir", dir, "show", "--end-of-options", ref).Output()
+	if err != nil {
+		fmt.Fprintf(w, "<p>error: %s</p>", err)
+		return
+	}
+	fmt.Fprint(w, "<pre>")
+	template.HTMLEscape(w, out)
+	fmt.Fprint(w, "</pre>")
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2014 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitbackend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSplitRepoView(t *testing.T) {
+	tests := []struct {
+		path     string
+		wantRepo string
+		wantView string
+	}{
+		{"camlistore.git", "camlistore", ""},
+		{"/camlistore.git/", "camlistore", ""},
+		{"camlistore.git/log", "camlistore", "log"},
+		{"camlistore.git/commit/abc123", "camlistore", "commit/abc123"},
+		{"camlistore.git/tree/master", "camlistore", "tree/master"},
+		{"no-dot-git-suffix", "", ""},
+	}
+	for _, tt := range tests {
+		repo, view := splitRepoView(tt.path)
+		if repo != tt.wantRepo || view != tt.wantView {
+			t.Errorf("splitRepoView(%q) = (%q, %q), want (%q, %q)", tt.path, repo, view, tt.wantRepo, tt.wantView)
+		}
+	}
+}
+
+func TestServerRepoDir(t *testing.T) {
+	s := &Server{Dir: "/srv/git"}
+	tests := []struct {
+		repo string
+		want string
+	}{
+		{"camlistore", "/srv/git/camlistore.git"},
+		{"camlistore.git", "/srv/git/camlistore.git"},
+		{"/camlistore/", "/srv/git/camlistore.git"},
+	}
+	for _, tt := range tests {
+		if got := s.repoDir(tt.repo); got != tt.want {
+			t.Errorf("repoDir(%q) = %q, want %q", tt.repo, got, tt.want)
+		}
+	}
+}
+
+// TestServeBrowseEscapesRepoName guards against the reflected-XSS
+// regression where an HTML-special repo name taken straight off the
+// URL path was written into <title>/<h1> unescaped.
+func TestServeBrowseEscapesRepoName(t *testing.T) {
+	s := &Server{Dir: t.TempDir()}
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/<script>alert(1)</script>.git/log", nil)
+	s.serveBrowse(rec, req, "<script>alert(1)</script>.git/log")
+
+	body := rec.Body.String()
+	if want := "<script>alert(1)</script>"; strings.Contains(body, want) {
+		t.Errorf("serveBrowse wrote unescaped repo name into response: %s", body)
+	}
+	if want := "&lt;script&gt;"; !strings.Contains(body, want) {
+		t.Errorf("serveBrowse response missing escaped repo name, got: %s", body)
+	}
+}
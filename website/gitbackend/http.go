@@ -0,0 +1,188 @@
+/*
+Copyright 2014 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package gitbackend implements the git smart-HTTP protocol
+// (info/refs, git-upload-pack, git-receive-pack) on top of the local
+// "git" binary, along with a small HTML browser for trees, blobs,
+// commits and logs.
+//
+// The wire handling is modeled on Gogs' internal/route/repo/http.go:
+// GET /info/refs with ?service=git-upload-pack or git-receive-pack
+// writes the "# service=" pkt-line and a flush-pkt before handing off
+// to "git <service> --stateless-rpc --advertise-refs"; POST
+// /<repo>/git-<service> pipes the (optionally gzipped) request body
+// into "git <service> --stateless-rpc" and streams stdout back.
+package gitbackend
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Server serves one or more bare git repositories over the smart-HTTP
+// protocol, plus an HTML browser for tree/blob/commit/log views.
+type Server struct {
+	// Dir is the parent directory containing bare repositories
+	// (e.g. Dir/camlistore.git).
+	Dir string
+
+	// GitBinary is the path to the git executable. If empty, "git"
+	// is looked up on $PATH.
+	GitBinary string
+
+	// CORS, if true, answers OPTIONS preflight requests and sets
+	// Access-Control-Allow-Origin: * on every response.
+	CORS bool
+
+	// Auth, if non-nil, is consulted before every request. It
+	// should write an error response and return false to deny the
+	// request.
+	Auth func(w http.ResponseWriter, r *http.Request) bool
+}
+
+var services = []string{"git-upload-pack", "git-receive-pack"}
+
+func (s *Server) gitBinary() string {
+	if s.GitBinary != "" {
+		return s.GitBinary
+	}
+	return "git"
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.CORS {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+	}
+	if s.Auth != nil && !s.Auth(w, r) {
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	switch {
+	case r.Method == "GET" && strings.HasSuffix(path, "/info/refs"):
+		s.serveInfoRefs(w, r, strings.TrimSuffix(path, "/info/refs"))
+		return
+	case r.Method == "POST":
+		for _, service := range services {
+			suffix := "/" + service
+			if strings.HasSuffix(path, suffix) {
+				s.serveService(w, r, strings.TrimSuffix(path, suffix), service)
+				return
+			}
+		}
+	}
+	s.serveBrowse(w, r, path)
+}
+
+func (s *Server) repoDir(repo string) string {
+	repo = strings.TrimSuffix(strings.Trim(repo, "/"), ".git")
+	return filepath.Join(s.Dir, repo+".git")
+}
+
+// serveInfoRefs handles GET /<repo>/info/refs?service=git-upload-pack
+// (the "dumb" fallback, without a ?service parameter, is not
+// supported; clients are expected to speak the smart protocol).
+func (s *Server) serveInfoRefs(w http.ResponseWriter, r *http.Request, repo string) {
+	service := r.FormValue("service")
+	if !validService(service) {
+		http.Error(w, "unsupported service", http.StatusBadRequest)
+		return
+	}
+	dir := s.repoDir(repo)
+
+	w.Header().Set("Content-Type", fmt.Sprintf("application/x-%s-advertisement", service))
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	writePktLine(w, fmt.Sprintf("# service=%s\n", service))
+	w.Write(flushPkt)
+
+	cmd := exec.Command(s.gitBinary(), strings.TrimPrefix(service, "git-"), "--stateless-rpc", "--advertise-refs", dir)
+	cmd.Stdout = w
+	cmd.Stderr = logWriter{service: service, repo: repo}
+	if err := cmd.Run(); err != nil {
+		log.Printf("gitbackend: %s --advertise-refs %s: %v", service, dir, err)
+	}
+}
+
+// serveService handles POST /<repo>/<service>.
+func (s *Server) serveService(w http.ResponseWriter, r *http.Request, repo, service string) {
+	if !validService(service) {
+		http.Error(w, "unsupported service", http.StatusBadRequest)
+		return
+	}
+	dir := s.repoDir(repo)
+
+	body := r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, "malformed gzip body", http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	w.Header().Set("Content-Type", fmt.Sprintf("application/x-%s-result", service))
+	w.Header().Set("Cache-Control", "no-cache")
+
+	cmd := exec.Command(s.gitBinary(), strings.TrimPrefix(service, "git-"), "--stateless-rpc", dir)
+	cmd.Stdin = body
+	cmd.Stdout = w
+	cmd.Stderr = logWriter{service: service, repo: repo}
+	if err := cmd.Run(); err != nil {
+		log.Printf("gitbackend: %s --stateless-rpc %s: %v", service, dir, err)
+	}
+}
+
+func validService(service string) bool {
+	for _, v := range services {
+		if v == service {
+			return true
+		}
+	}
+	return false
+}
+
+var flushPkt = []byte("0000")
+
+// writePktLine writes s as a git pkt-line: a 4-byte hex length prefix
+// (including itself) followed by s.
+func writePktLine(w io.Writer, s string) {
+	fmt.Fprintf(w, "%04x%s", len(s)+4, s)
+}
+
+type logWriter struct {
+	service, repo string
+}
+
+func (lw logWriter) Write(p []byte) (int, error) {
+	log.Printf("gitbackend: %s %s: %s", lw.service, lw.repo, p)
+	return len(p), nil
+}
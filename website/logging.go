@@ -0,0 +1,177 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// requestIDKey is the context.Context key under which the per-request
+// ID set by the logging handler is stored.
+type requestIDKey struct{}
+
+// requestIDFromContext returns the request ID stashed by
+// NewLoggingHandler, or "" if ctx has none (e.g. in tests).
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// loggingHandler wraps an http.Handler, logging one structured JSON
+// line per request to a file that rotates hourly under dir (when dir
+// is non-empty) and/or to stdout.
+type loggingHandler struct {
+	handler http.Handler
+	dir     string
+	stdout  bool
+
+	mu      sync.Mutex
+	curHour time.Time
+	curFile *os.File
+}
+
+// NewLoggingHandler returns a handler that logs each request handled
+// by h as a JSON object (method, path, status, bytes, duration,
+// remote IP, user-agent, referer and a generated request ID) to dir
+// (one file per hour, if dir is non-empty) and/or stdout.
+func NewLoggingHandler(h http.Handler, dir string, stdout bool) http.Handler {
+	return &loggingHandler{handler: h, dir: dir, stdout: stdout}
+}
+
+// logEntry is the structured record written per request.
+type logEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"requestID"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Duration  float64   `json:"durationSec"`
+	RemoteIP  string    `json:"remoteIP"`
+	UserAgent string    `json:"userAgent"`
+	Referer   string    `json:"referer"`
+}
+
+func (h *loggingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := newRequestID()
+	w.Header().Set("X-Request-ID", id)
+	ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+	r = r.WithContext(ctx)
+
+	lrw := &loggingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+	start := time.Now()
+	h.handler.ServeHTTP(lrw, r)
+	dur := time.Since(start)
+
+	entry := logEntry{
+		Time:      start,
+		RequestID: id,
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Status:    lrw.status,
+		Bytes:     lrw.bytes,
+		Duration:  dur.Seconds(),
+		RemoteIP:  remoteIP(r),
+		UserAgent: r.Header.Get("User-Agent"),
+		Referer:   r.Header.Get("Referer"),
+	}
+	h.write(entry)
+}
+
+func (h *loggingHandler) write(entry logEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("logging: marshal: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	if h.stdout {
+		os.Stdout.Write(line)
+	}
+	if h.dir == "" {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hour := entry.Time.Truncate(time.Hour)
+	if h.curFile == nil || !hour.Equal(h.curHour) {
+		if h.curFile != nil {
+			h.curFile.Close()
+		}
+		name := filepath.Join(h.dir, hour.Format("2006-01-02-15")+".log")
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Printf("logging: open %s: %v", name, err)
+			return
+		}
+		h.curFile, h.curHour = f, hour
+	}
+	h.curFile.Write(line)
+}
+
+// remoteIP returns the client's address, honoring the left-most
+// entry of X-Forwarded-For when present (e.g. behind a reverse
+// proxy or load balancer).
+func remoteIP(r *http.Request) string {
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+		return strings.TrimSpace(strings.Split(fwd, ",")[0])
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+func newRequestID() string {
+	var b [12]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return fmt.Sprintf("%x", b)
+}
+
+// loggingResponseWriter records the status code and byte count
+// written through it.
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *loggingResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *loggingResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
@@ -0,0 +1,184 @@
+/*
+Copyright 2014 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+	bf "github.com/russross/blackfriday/v2"
+	"gopkg.in/yaml.v2"
+)
+
+// frontMatter is the optional metadata block at the top of a .md
+// file, delimited by "---\n...\n---\n" (YAML) or "+++\n...\n+++\n"
+// (TOML).
+type frontMatter struct {
+	Title    string `yaml:"title" toml:"title"`
+	Subtitle string `yaml:"subtitle" toml:"subtitle"`
+	Template string `yaml:"template" toml:"template"`
+	Redirect string `yaml:"redirect" toml:"redirect"`
+	Draft    bool   `yaml:"draft" toml:"draft"`
+}
+
+// splitFrontMatter pulls a leading front-matter block off data, if
+// present, returning the parsed metadata and the remaining body.
+func splitFrontMatter(data []byte) (fm frontMatter, body []byte, err error) {
+	body = data
+	switch {
+	case bytes.HasPrefix(data, []byte("---\n")):
+		rest := data[len("---\n"):]
+		end := bytes.Index(rest, []byte("\n---\n"))
+		if end < 0 {
+			return fm, data, fmt.Errorf("unterminated YAML front matter")
+		}
+		if err := yaml.Unmarshal(rest[:end], &fm); err != nil {
+			return fm, data, fmt.Errorf("front matter: %v", err)
+		}
+		body = rest[end+len("\n---\n"):]
+	case bytes.HasPrefix(data, []byte("+++\n")):
+		rest := data[len("+++\n"):]
+		end := bytes.Index(rest, []byte("\n+++\n"))
+		if end < 0 {
+			return fm, data, fmt.Errorf("unterminated TOML front matter")
+		}
+		if err := toml.Unmarshal(rest[:end], &fm); err != nil {
+			return fm, data, fmt.Errorf("front matter: %v", err)
+		}
+		body = rest[end+len("\n+++\n"):]
+	}
+	return fm, body, nil
+}
+
+// tocEntry is one entry in a rendered page's table of contents.
+type tocEntry struct {
+	Level int
+	ID    string
+	Title string
+}
+
+// renderMarkdown renders CommonMark body to HTML, auto-linking
+// headings and syntax-highlighting fenced code blocks, and returns
+// the table of contents gathered along the way.
+func renderMarkdown(body []byte) (html []byte, toc []tocEntry) {
+	renderer := &tocRenderer{
+		Renderer: bf.NewHTMLRenderer(bf.HTMLRendererParameters{
+			Flags: bf.CommonHTMLFlags | bf.FootnoteReturnLinks,
+		}),
+	}
+	extensions := bf.CommonExtensions | bf.AutoHeadingIDs
+	out := bf.Run(body, bf.WithRenderer(renderer), bf.WithExtensions(extensions))
+	return out, renderer.toc
+}
+
+// tocRenderer wraps blackfriday's HTML renderer to collect heading
+// IDs/titles into a table of contents and to syntax-highlight fenced
+// code blocks via chroma.
+type tocRenderer struct {
+	bf.Renderer
+	toc []tocEntry
+}
+
+func (r *tocRenderer) RenderNode(w io.Writer, node *bf.Node, entering bool) bf.WalkStatus {
+	switch node.Type {
+	case bf.Heading:
+		if entering {
+			var buf bytes.Buffer
+			collectText(&buf, node)
+			r.toc = append(r.toc, tocEntry{
+				Level: node.Level,
+				ID:    node.HeadingID,
+				Title: buf.String(),
+			})
+		}
+	case bf.CodeBlock:
+		if highlightCodeBlock(w, node) {
+			return bf.GoToNext
+		}
+	}
+	return r.Renderer.RenderNode(w, node, entering)
+}
+
+func collectText(buf *bytes.Buffer, node *bf.Node) {
+	for n := node.FirstChild; n != nil; n = n.Next {
+		if n.Literal != nil {
+			buf.Write(n.Literal)
+		}
+		collectText(buf, n)
+	}
+}
+
+// highlightCodeBlock renders node (a fenced code block) as
+// syntax-highlighted HTML via chroma, writing to w. It returns false
+// (doing nothing) if node's language isn't recognized, letting the
+// caller fall back to the default renderer.
+func highlightCodeBlock(w io.Writer, node *bf.Node) bool {
+	lang := strings.TrimSpace(string(node.CodeBlockData.Info))
+	if lang == "" {
+		return false
+	}
+	lexer := lexers.Get(lang)
+	if lexer == nil {
+		return false
+	}
+	iter, err := lexer.Tokenise(nil, string(node.Literal))
+	if err != nil {
+		return false
+	}
+	formatter := html.New(html.WithClasses(true))
+	fmt.Fprintf(w, "<pre class=\"chroma\">")
+	if err := formatter.Format(w, styles.Get("github"), iter); err != nil {
+		return false
+	}
+	fmt.Fprintf(w, "</pre>")
+	return true
+}
+
+// serveMarkdown renders a .md file under content/ and feeds it into
+// servePage, honoring front-matter title/subtitle/redirect/draft.
+func serveMarkdown(rw http.ResponseWriter, req *http.Request, relPath string, data []byte) {
+	fm, body, err := splitFrontMatter(data)
+	if err != nil {
+		serveError(rw, req, relPath, err)
+		return
+	}
+	if fm.Draft && !*devMode {
+		http.NotFound(rw, req)
+		return
+	}
+	if fm.Redirect != "" {
+		http.Redirect(rw, req, fm.Redirect, http.StatusFound)
+		return
+	}
+
+	rendered, toc := renderMarkdown(body)
+
+	title := fm.Title
+	if title == "" {
+		if m := h1TitlePattern.FindSubmatch(rendered); len(m) > 1 {
+			title = string(m[1])
+		}
+	}
+	servePageTOC(rw, title, fm.Subtitle, rendered, toc)
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2014 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "testing"
+
+func TestSplitFrontMatter(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		wantFM   frontMatter
+		wantBody string
+		wantErr  bool
+	}{
+		{
+			name:     "no front matter",
+			data:     "# Hello\n\nworld\n",
+			wantBody: "# Hello\n\nworld\n",
+		},
+		{
+			name:     "yaml front matter",
+			data:     "---\ntitle: Hi\nsubtitle: There\ndraft: true\n---\nbody\n",
+			wantFM:   frontMatter{Title: "Hi", Subtitle: "There", Draft: true},
+			wantBody: "body\n",
+		},
+		{
+			name:     "toml front matter",
+			data:     "+++\ntitle = \"Hi\"\n+++\nbody\n",
+			wantFM:   frontMatter{Title: "Hi"},
+			wantBody: "body\n",
+		},
+		{
+			name:    "unterminated yaml front matter",
+			data:    "---\ntitle: Hi\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fm, body, err := splitFrontMatter([]byte(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("splitFrontMatter(%q) error = %v, wantErr %v", tt.data, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if fm != tt.wantFM {
+				t.Errorf("splitFrontMatter(%q) fm = %+v, want %+v", tt.data, fm, tt.wantFM)
+			}
+			if string(body) != tt.wantBody {
+				t.Errorf("splitFrontMatter(%q) body = %q, want %q", tt.data, body, tt.wantBody)
+			}
+		})
+	}
+}
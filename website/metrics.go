@@ -0,0 +1,113 @@
+/*
+Copyright 2014 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	metricRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "camweb_http_requests_total",
+		Help: "Total HTTP requests, labeled by route and status class.",
+	}, []string{"route", "status"})
+
+	metricLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "camweb_http_request_duration_seconds",
+		Help:    "HTTP request latency in seconds, labeled by route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route"})
+
+	metricBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "camweb_http_response_bytes_total",
+		Help: "Total bytes served, labeled by route.",
+	}, []string{"route"})
+
+	metricInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "camweb_http_requests_in_flight",
+		Help: "Number of HTTP requests currently being served.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(metricRequests, metricLatency, metricBytes, metricInFlight)
+}
+
+// routeLabel buckets req.URL.Path into one of a small, known set of
+// route labels, so metric cardinality stays bounded regardless of
+// how many distinct content paths are served.
+func routeLabel(path string) string {
+	switch {
+	case strings.HasPrefix(path, "/pkg/"), strings.HasPrefix(path, "/cmd/"):
+		return "/pkg/"
+	case strings.HasPrefix(path, "/code/"):
+		return "/code/"
+	case strings.HasPrefix(path, "/r/"):
+		return "/r/"
+	case strings.HasPrefix(path, "/static/"):
+		return "/static/"
+	case strings.HasPrefix(path, "/talks/"):
+		return "/talks/"
+	case strings.HasPrefix(path, "/debugz/"):
+		return "/debugz/"
+	case strings.HasPrefix(path, "/issue/"):
+		return "/issue/"
+	default:
+		return "/"
+	}
+}
+
+// recordMetrics updates the Prometheus metrics for one completed
+// request; it's called from metricsMiddleware so every served request
+// is accounted for exactly once.
+func recordMetrics(r *http.Request, status int, bytes int64, dur time.Duration) {
+	route := routeLabel(r.URL.Path)
+	metricRequests.WithLabelValues(route, statusClass(status)).Inc()
+	metricLatency.WithLabelValues(route).Observe(dur.Seconds())
+	metricBytes.WithLabelValues(route).Add(float64(bytes))
+}
+
+func statusClass(status int) string {
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// metricsMiddleware wraps h, tracking the in-flight gauge and
+// recording the request-count/latency/bytes metrics for every
+// request. It's installed unconditionally in buildHandler so
+// /metrics reports real traffic even when access logging (-logdir,
+// -logstdout) is turned off.
+func metricsMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mrw := &loggingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		metricInFlight.Inc()
+		defer metricInFlight.Dec()
+		h.ServeHTTP(mrw, r)
+		recordMetrics(r, mrw.status, mrw.bytes, time.Since(start))
+	})
+}
+
+// metricsHandler serves /metrics in the Prometheus exposition format.
+func metricsHandler() http.Handler {
+	return promhttp.Handler()
+}
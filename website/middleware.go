@@ -0,0 +1,254 @@
+/*
+Copyright 2014 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Middleware wraps an http.Handler to produce another, e.g. to add
+// authentication, access control, or rate limiting in front of it.
+type Middleware func(http.Handler) http.Handler
+
+// chain composes middlewares around h, applying them in the order
+// given: chain(h, a, b)'s requests flow a -> b -> h.
+func chain(h http.Handler, mw ...Middleware) http.Handler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
+// basicAuth returns middleware that requires HTTP Basic auth matching
+// one of the user:password-hash entries in an htpasswd-style file
+// (only the widely-supported "user:{SHA}base64(sha1(password))" and
+// plain-text "user:password" forms are understood). Requests with
+// valid credentials pass through unmodified. It returns an error
+// rather than dying outright so that a bad htpasswd file doesn't take
+// down a config reload triggered by SIGHUP (see buildHandler).
+func basicAuth(htpasswdFile, realm string) (Middleware, error) {
+	creds, err := readHtpasswd(htpasswdFile)
+	if err != nil {
+		return nil, fmt.Errorf("middleware: reading htpasswd file %s: %v", htpasswdFile, err)
+	}
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, pass, ok := r.BasicAuth()
+			if !ok || !creds.verify(user, pass) {
+				w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`"`)
+				http.Error(w, "authorization required", http.StatusUnauthorized)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+type htpasswd map[string]string // user -> password or "{SHA}..." hash
+
+func readHtpasswd(name string) (htpasswd, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	creds := make(htpasswd)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			continue
+		}
+		creds[line[:i]] = line[i+1:]
+	}
+	return creds, sc.Err()
+}
+
+func (h htpasswd) verify(user, pass string) bool {
+	want, ok := h[user]
+	if !ok {
+		return false
+	}
+	if strings.HasPrefix(want, "{SHA}") {
+		return subtle.ConstantTimeCompare([]byte(want), []byte(sha1Htpasswd(pass))) == 1
+	}
+	return subtle.ConstantTimeCompare([]byte(want), []byte(pass)) == 1
+}
+
+func sha1Htpasswd(pass string) string {
+	sum := sha1.Sum([]byte(pass))
+	return "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// ipFilter returns middleware that rejects requests from remote IPs
+// matching deny (unless allow is non-empty, in which case only IPs
+// matching allow are accepted). Entries may be single IPs or CIDR
+// blocks. It returns an error rather than dying outright so that a
+// typo'd CIDR doesn't take down a config reload triggered by SIGHUP
+// (see buildHandler).
+func ipFilter(allow, deny []string) (Middleware, error) {
+	allowNets, err := parseNets(allow)
+	if err != nil {
+		return nil, err
+	}
+	denyNets, err := parseNets(deny)
+	if err != nil {
+		return nil, err
+	}
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := clientIP(r)
+			if len(allowNets) > 0 && !anyContains(allowNets, ip) {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			if anyContains(denyNets, ip) {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+func parseNets(specs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range specs {
+		if !strings.Contains(s, "/") {
+			if strings.Contains(s, ":") {
+				s += "/128"
+			} else {
+				s += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("middleware: invalid IP/CIDR %q: %v", s, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func anyContains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// rateLimit returns middleware allowing at most n requests per
+// interval from a given remote IP, replying 429 once the limit is
+// exceeded. Buckets for IPs that haven't been seen in a while are
+// swept out on access so that a route under rate limiting doesn't
+// leak one *bucket per distinct client IP for the life of the
+// process.
+func rateLimit(n int, interval time.Duration) Middleware {
+	type bucket struct {
+		count int
+		reset time.Time
+	}
+	var (
+		mu        sync.Mutex
+		buckets   = make(map[string]*bucket)
+		nextSweep time.Time
+	)
+	const sweepInterval = 10 * time.Minute
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := clientIP(r).String()
+			now := time.Now()
+
+			mu.Lock()
+			if now.After(nextSweep) {
+				for k, b := range buckets {
+					if now.After(b.reset) {
+						delete(buckets, k)
+					}
+				}
+				nextSweep = now.Add(sweepInterval)
+			}
+			b, ok := buckets[ip]
+			if !ok || now.After(b.reset) {
+				b = &bucket{reset: now.Add(interval)}
+				buckets[ip] = b
+			}
+			b.count++
+			over := b.count > n
+			mu.Unlock()
+
+			if over {
+				http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// botRule denies requests whose User-Agent matches Pattern, for
+// requests whose path has the given Prefix.
+type botRule struct {
+	Prefix  string
+	Pattern *regexp.Regexp
+}
+
+// botPolicy returns middleware that denies requests matching any of
+// rules, replacing the old hard-coded Baidu/bingbot/Googlebot checks
+// in noWwwHandler with a data-driven policy.
+func botPolicy(rules []botRule) Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			agent := r.Header.Get("User-Agent")
+			for _, rule := range rules {
+				if strings.HasPrefix(r.URL.Path, rule.Prefix) && rule.Pattern.MatchString(agent) {
+					http.Error(w, "bye", http.StatusUnauthorized)
+					log.Printf("bot denied: %s %s", r.URL.Path, agent)
+					return
+				}
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
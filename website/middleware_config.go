@@ -0,0 +1,137 @@
+/*
+Copyright 2014 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+)
+
+// middlewareConfig is the on-disk (JSON) description of which
+// middlewares guard which route prefixes, and in what order. It's
+// intentionally narrow for now; see -middlewareconf.
+type middlewareConfig struct {
+	// Routes maps a mux pattern prefix (e.g. "/debugz/", "/code/")
+	// to the middlewares that should wrap it, applied in order.
+	Routes map[string]routeConfig `json:"routes"`
+
+	// BotRules replaces the old hard-coded Baidu/bingbot/Googlebot
+	// substring checks with a data-driven policy, applied ahead of
+	// everything else.
+	BotRules []botRuleConfig `json:"botRules"`
+}
+
+type routeConfig struct {
+	HtpasswdFile string   `json:"htpasswdFile"`
+	Realm        string   `json:"realm"`
+	AllowIPs     []string `json:"allowIPs"`
+	DenyIPs      []string `json:"denyIPs"`
+	RateLimit    int      `json:"rateLimit"`    // requests per RateLimitSec window; 0 disables
+	RateLimitSec int      `json:"rateLimitSec"` // window length in seconds; default 60
+}
+
+type botRuleConfig struct {
+	Prefix  string `json:"prefix"`
+	Pattern string `json:"pattern"`
+}
+
+// loadMiddlewareConfig returns an error rather than dying outright so
+// that a bad or mid-rewrite config file doesn't take down a config
+// reload triggered by SIGHUP (see buildHandler).
+func loadMiddlewareConfig(name string) (*middlewareConfig, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("middleware: opening config %s: %v", name, err)
+	}
+	defer f.Close()
+	var c middlewareConfig
+	if err := json.NewDecoder(f).Decode(&c); err != nil {
+		return nil, fmt.Errorf("middleware: parsing config %s: %v", name, err)
+	}
+	return &c, nil
+}
+
+// botMiddleware builds the bot-denial middleware described by c,
+// falling back to the historical Baidu/bingbot/Ezooms/Googlebot rule
+// on /code/ when no config is given.
+func (c *middlewareConfig) botMiddleware() (Middleware, error) {
+	if c == nil || len(c.BotRules) == 0 {
+		return botPolicy([]botRule{
+			{Prefix: "/code/", Pattern: regexp.MustCompile(`Baidu|bingbot|Ezooms|Googlebot`)},
+		}), nil
+	}
+	rules := make([]botRule, len(c.BotRules))
+	for i, r := range c.BotRules {
+		pat, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("middleware: bad bot rule pattern %q: %v", r.Pattern, err)
+		}
+		rules[i] = botRule{Prefix: r.Prefix, Pattern: pat}
+	}
+	return botPolicy(rules), nil
+}
+
+// middlewaresFor returns the auth/IP/rate-limit middlewares declared
+// for the route registered under prefix, in the order they should
+// wrap the handler (outermost first).
+func (c *middlewareConfig) middlewaresFor(prefix string) ([]Middleware, error) {
+	if c == nil {
+		return nil, nil
+	}
+	rc, ok := c.Routes[prefix]
+	if !ok {
+		return nil, nil
+	}
+	var mw []Middleware
+	if len(rc.AllowIPs) > 0 || len(rc.DenyIPs) > 0 {
+		m, err := ipFilter(rc.AllowIPs, rc.DenyIPs)
+		if err != nil {
+			return nil, err
+		}
+		mw = append(mw, m)
+	}
+	if rc.RateLimit > 0 {
+		window := time.Duration(rc.RateLimitSec) * time.Second
+		if window <= 0 {
+			window = time.Minute
+		}
+		mw = append(mw, rateLimit(rc.RateLimit, window))
+	}
+	if rc.HtpasswdFile != "" {
+		m, err := basicAuth(rc.HtpasswdFile, rc.Realm)
+		if err != nil {
+			return nil, err
+		}
+		mw = append(mw, m)
+	}
+	return mw, nil
+}
+
+// handle registers handler under prefix on mux, wrapped with any
+// middlewares configured for prefix.
+func (c *middlewareConfig) handle(mux *http.ServeMux, prefix string, handler http.Handler) error {
+	mw, err := c.middlewaresFor(prefix)
+	if err != nil {
+		return err
+	}
+	mux.Handle(prefix, chain(handler, mw...))
+	return nil
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2014 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHtpasswdVerify(t *testing.T) {
+	creds := htpasswd{
+		"plain": "secret",
+		"sha":   sha1Htpasswd("secret"),
+	}
+	tests := []struct {
+		user, pass string
+		want       bool
+	}{
+		{"plain", "secret", true},
+		{"plain", "wrong", false},
+		{"sha", "secret", true},
+		{"sha", "wrong", false},
+		{"nosuchuser", "secret", false},
+	}
+	for _, tt := range tests {
+		if got := creds.verify(tt.user, tt.pass); got != tt.want {
+			t.Errorf("verify(%q, %q) = %v, want %v", tt.user, tt.pass, got, tt.want)
+		}
+	}
+}
+
+func TestRateLimitResetsAfterWindow(t *testing.T) {
+	mw := rateLimit(1, 10*time.Millisecond)
+	h := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/code/", nil)
+	req.RemoteAddr = "203.0.113.1:1234"
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("first request: got status %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("second request within window: got status %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("request after window reset: got status %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestRateLimitPerIP(t *testing.T) {
+	mw := rateLimit(1, time.Minute)
+	h := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for _, addr := range []string{"203.0.113.1:1", "203.0.113.2:1"} {
+		req := httptest.NewRequest(http.MethodGet, "/code/", nil)
+		req.RemoteAddr = addr
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Errorf("first request from %s: got status %d, want %d", addr, rec.Code, http.StatusOK)
+		}
+	}
+}
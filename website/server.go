@@ -0,0 +1,242 @@
+/*
+Copyright 2014 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// server owns the root http.Handler and the HTTP/HTTPS listeners
+// built from it, and knows how to swap both in place on a config
+// reload (SIGHUP) without dropping in-flight connections: the
+// handler is swapped via an atomic.Value that every request reads
+// from, and a listener is only torn down and restarted (via a
+// graceful http.Server.Shutdown, overlapping with the replacement
+// coming up) when its address or TLS settings actually changed.
+type server struct {
+	handler     atomic.Value // http.Handler
+	acmeManager atomic.Value // *autocert.Manager, or nil
+
+	errc chan error
+
+	mu          sync.Mutex // guards the rest
+	cfg         *Config
+	listenerSig string // addr+TLS-mode fingerprint of the running listeners
+	httpSrv     *http.Server
+	httpsSrv    *http.Server
+}
+
+func newServer() *server {
+	return &server{errc: make(chan error, 2)}
+}
+
+// dispatch returns the stable http.Handler installed on every
+// http.Server; it always serves whatever handler was most recently
+// stored by reload, so swapping the handler never requires touching
+// the listeners.
+func (s *server) dispatch() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h, _ := s.handler.Load().(http.Handler)
+		if h == nil {
+			http.Error(w, "server starting up", http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (s *server) currentAcmeManager() *autocert.Manager {
+	m, _ := s.acmeManager.Load().(*autocert.Manager)
+	return m
+}
+
+func listenerSignature(cfg *Config) string {
+	return strings.Join([]string{
+		cfg.HTTPAddr,
+		cfg.HTTPSAddr,
+		cfg.TLSCertFile,
+		cfg.TLSKeyFile,
+		strings.Join(cfg.AutocertHosts, ","),
+		cfg.AutocertCacheDir,
+	}, "\x00")
+}
+
+// reload builds the handler for cfg and installs it, starting the
+// HTTP/HTTPS listeners on first call and restarting them in place
+// only if cfg's addresses or TLS settings differ from what's
+// currently running.
+func (s *server) reload(cfg *Config) error {
+	handler, err := buildHandler(cfg)
+	if err != nil {
+		return err
+	}
+
+	var mgr *autocert.Manager
+	if len(cfg.AutocertHosts) > 0 {
+		cacheDir := cfg.AutocertCacheDir
+		if !filepath.IsAbs(cacheDir) {
+			cacheDir = filepath.Join(cfg.Root, cacheDir)
+		}
+		os.MkdirAll(cacheDir, 0700)
+		mgr = autocertManager(cacheDir, cfg.AutocertHosts)
+		handler = hstsHandler(handler)
+	}
+
+	// Swap the handler (and ACME manager) in place; every in-flight
+	// and future request on the existing listeners picks this up
+	// immediately via s.dispatch, with no listener churn at all.
+	s.handler.Store(handler)
+	s.acmeManager.Store(mgr)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sig := listenerSignature(cfg)
+	restart := s.cfg == nil || sig != s.listenerSig
+	s.cfg = cfg
+	if !restart {
+		return nil
+	}
+	s.listenerSig = sig
+	return s.restartListeners(cfg, mgr)
+}
+
+// restartListeners gracefully drains any previously running
+// http.Server (via Shutdown, which waits for in-flight requests) and
+// starts new ones for cfg. Must be called with s.mu held.
+func (s *server) restartListeners(cfg *Config, mgr *autocert.Manager) error {
+	oldHTTP, oldHTTPS := s.httpSrv, s.httpsSrv
+
+	httpHandler := s.dispatch()
+	if mgr != nil {
+		httpHandler = httpChallengeRedirect(s)
+	}
+	s.httpSrv = &http.Server{
+		Addr:         cfg.HTTPAddr,
+		Handler:      httpHandler,
+		ReadTimeout:  5 * time.Minute,
+		WriteTimeout: 30 * time.Minute,
+	}
+	httpSrv := s.httpSrv
+	go func() {
+		if err := httpSrv.ListenAndServe(); err != http.ErrServerClosed {
+			s.errc <- err
+		}
+	}()
+
+	switch {
+	case mgr != nil:
+		log.Printf("Starting autocert TLS server on %s", cfg.HTTPSAddr)
+		s.httpsSrv = &http.Server{
+			Addr:         cfg.HTTPSAddr,
+			Handler:      s.dispatch(),
+			ReadTimeout:  5 * time.Minute,
+			WriteTimeout: 30 * time.Minute,
+			TLSConfig:    &tls.Config{GetCertificate: acmeGetCertificate(s)},
+		}
+		httpsSrv := s.httpsSrv
+		go func() {
+			if err := httpsSrv.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
+				s.errc <- err
+			}
+		}()
+	case cfg.HTTPSAddr != "":
+		log.Printf("Starting TLS server on %s", cfg.HTTPSAddr)
+		s.httpsSrv = &http.Server{
+			Addr:         cfg.HTTPSAddr,
+			Handler:      s.dispatch(),
+			ReadTimeout:  5 * time.Minute,
+			WriteTimeout: 30 * time.Minute,
+		}
+		httpsSrv := s.httpsSrv
+		go func(certFile, keyFile string) {
+			if err := httpsSrv.ListenAndServeTLS(certFile, keyFile); err != http.ErrServerClosed {
+				s.errc <- err
+			}
+		}(cfg.TLSCertFile, cfg.TLSKeyFile)
+	default:
+		s.httpsSrv = nil
+	}
+
+	drain(oldHTTP)
+	drain(oldHTTPS)
+	return nil
+}
+
+// acmeGetCertificate returns a tls.Config.GetCertificate callback
+// that always delegates to the ACME manager currently installed on
+// s, so an autocert config change on reload doesn't require
+// recreating the HTTPS listener.
+func acmeGetCertificate(s *server) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return s.currentAcmeManager().GetCertificate(hello)
+	}
+}
+
+// drain gracefully shuts srv down in the background, if non-nil.
+func drain(srv *http.Server) {
+	if srv == nil {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("server: shutting down previous listener %s: %v", srv.Addr, err)
+		}
+	}()
+}
+
+// watchSIGHUP re-reads the config and reloads the server on every
+// SIGHUP, logging (rather than dying) on failure so a bad edit to
+// the config file doesn't take the whole process down.
+func (s *server) watchSIGHUP() {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	for range sighup {
+		cfg, err := currentConfig()
+		if err != nil {
+			log.Printf("SIGHUP: loading config: %v", err)
+			continue
+		}
+		if cfg.Root == "" {
+			cfg.Root = *root
+		}
+		if err := readTemplates(); err != nil {
+			log.Printf("SIGHUP: parsing templates: %v", err)
+			continue
+		}
+		if err := s.reload(cfg); err != nil {
+			log.Printf("SIGHUP: reloading: %v", err)
+			continue
+		}
+		log.Printf("SIGHUP: reloaded config")
+	}
+}
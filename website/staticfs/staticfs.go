@@ -0,0 +1,341 @@
+/*
+Copyright 2014 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package staticfs serves content-addressable static assets: on
+// startup (and, in dev mode, on every change) it walks a set of root
+// directories, fingerprints each file by its SHA-256 digest, and
+// pre-compresses it with gzip and brotli so requests can be answered
+// with a strong ETag, immutable caching for fingerprinted paths, and
+// content-negotiated Accept-Encoding.
+package staticfs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/fsnotify/fsnotify"
+)
+
+// asset is one scanned file, along with its pre-compressed variants.
+type asset struct {
+	path    string // logical path, e.g. "css/site.css"
+	sha256  string // hex digest of the uncompressed content
+	modTime time.Time
+
+	raw    []byte
+	gzip   []byte
+	brotli []byte
+}
+
+func (a *asset) etag() string {
+	return `"` + a.sha256[:16] + `"`
+}
+
+// fingerprintedName returns the content-addressable name for a, e.g.
+// "site.<hash12>.css" for "site.css".
+func fingerprintedName(logicalPath, digest string) string {
+	dir, base := filepath.Split(logicalPath)
+	ext := filepath.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+	return filepath.Join(dir, fmt.Sprintf("%s.%s%s", stem, digest[:12], ext))
+}
+
+// FS serves a content-addressable view of one or more root
+// directories, each mounted at a URL prefix.
+type FS struct {
+	// Dev, if true, watches the roots with fsnotify and rescans on
+	// any change instead of only at startup.
+	Dev bool
+
+	mu            sync.RWMutex
+	roots         map[string]string // url prefix -> directory
+	assets        map[string]*asset // "<prefix><relpath>" -> asset
+	byFingerprint map[string]string // fingerprinted logical path -> plain logical path (for asset lookups)
+
+	watcher *fsnotify.Watcher
+}
+
+// New creates an FS. Call Mount for each root directory before
+// ServeHTTP is used.
+func New() *FS {
+	return &FS{
+		roots:         make(map[string]string),
+		assets:        make(map[string]*asset),
+		byFingerprint: make(map[string]string),
+	}
+}
+
+// Mount registers dir to be served (recursively) under urlPrefix
+// (e.g. "/static/") and scans it immediately.
+func (fs *FS) Mount(urlPrefix, dir string) error {
+	urlPrefix = strings.TrimSuffix(urlPrefix, "/") + "/"
+	fs.mu.Lock()
+	fs.roots[urlPrefix] = dir
+	fs.mu.Unlock()
+
+	if err := fs.scan(urlPrefix, dir); err != nil {
+		return err
+	}
+	if fs.Dev {
+		return fs.watch(dir)
+	}
+	return nil
+}
+
+func (fs *FS) scan(urlPrefix, dir string) error {
+	assets := make(map[string]*asset)
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		a := buildAsset(urlPrefix+filepath.ToSlash(rel), data, fi.ModTime())
+		assets[a.path] = a
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// Drop anything under urlPrefix from the previous scan that's
+	// gone or changed content, so a deleted/renamed/edited file in
+	// -dev mode doesn't keep being served (under its old logical
+	// and/or fingerprinted path) forever.
+	for path, old := range fs.assets {
+		if !strings.HasPrefix(path, urlPrefix) {
+			continue
+		}
+		cur, ok := assets[path]
+		if !ok || cur.sha256 != old.sha256 {
+			delete(fs.byFingerprint, fingerprintedName(path, old.sha256))
+		}
+		if !ok {
+			delete(fs.assets, path)
+		}
+	}
+	for path, a := range assets {
+		fs.assets[path] = a
+		fp := fingerprintedName(path, a.sha256)
+		fs.byFingerprint[fp] = path
+	}
+	return nil
+}
+
+func buildAsset(logicalPath string, data []byte, modTime time.Time) *asset {
+	sum := sha256.Sum256(data)
+	a := &asset{
+		path:    logicalPath,
+		sha256:  fmt.Sprintf("%x", sum),
+		modTime: modTime,
+		raw:     data,
+	}
+
+	var gzBuf bytes.Buffer
+	gw, _ := gzip.NewWriterLevel(&gzBuf, gzip.BestCompression)
+	gw.Write(data)
+	gw.Close()
+	a.gzip = gzBuf.Bytes()
+
+	var brBuf bytes.Buffer
+	bw := brotli.NewWriterLevel(&brBuf, brotli.BestCompression)
+	bw.Write(data)
+	bw.Close()
+	a.brotli = brBuf.Bytes()
+
+	return a
+}
+
+// watch re-scans dir's mount point whenever fsnotify reports a
+// change under it.
+func (fs *FS) watch(dir string) error {
+	fs.mu.Lock()
+	if fs.watcher == nil {
+		w, err := fsnotify.NewWatcher()
+		if err != nil {
+			fs.mu.Unlock()
+			return err
+		}
+		fs.watcher = w
+		go fs.watchLoop()
+	}
+	watcher := fs.watcher
+	fs.mu.Unlock()
+
+	return filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return watcher.Add(path)
+		}
+		return nil
+	})
+}
+
+func (fs *FS) watchLoop() {
+	for event := range fs.watcher.Events {
+		fs.mu.RLock()
+		roots := make(map[string]string, len(fs.roots))
+		for k, v := range fs.roots {
+			roots[k] = v
+		}
+		fs.mu.RUnlock()
+
+		for prefix, dir := range roots {
+			if strings.HasPrefix(event.Name, dir) {
+				if err := fs.scan(prefix, dir); err != nil {
+					log.Printf("staticfs: rescanning %s after %s: %v", dir, event, err)
+				}
+				break
+			}
+		}
+	}
+}
+
+// AssetURL returns the fingerprinted URL for logicalPath (e.g.
+// "/static/css/site.css" -> "/static/css/site.<hash>.css"), or
+// logicalPath unchanged if it isn't a known asset. It backs the
+// "{{asset "css/site.css"}}" template helper.
+func (fs *FS) AssetURL(logicalPath string) string {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	a, ok := fs.assets[logicalPath]
+	if !ok {
+		return logicalPath
+	}
+	return fingerprintedName(logicalPath, a.sha256)
+}
+
+// Rewrite returns a handler that serves the single asset at
+// logicalPath from fs, regardless of the incoming request path. It's
+// useful for mounting individual top-level files, such as
+// /favicon.ico, out of a prefix-mounted root.
+func Rewrite(fs *FS, logicalPath string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = logicalPath
+		fs.ServeHTTP(w, r2)
+	})
+}
+
+// ServeHTTP implements http.Handler, serving any mounted asset by
+// either its logical or fingerprinted path.
+func (fs *FS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+
+	fs.mu.RLock()
+	a, ok := fs.assets[path]
+	if !ok {
+		if logical, ok2 := fs.byFingerprint[path]; ok2 {
+			a, ok = fs.assets[logical], true
+		}
+	}
+	if !ok {
+		fs.mu.RUnlock()
+		http.NotFound(w, r)
+		return
+	}
+	fingerprinted := path != a.path
+	fs.mu.RUnlock()
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" && inm == a.etag() {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		if t, err := time.Parse(http.TimeFormat, ims); err == nil && !a.modTime.After(t) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	w.Header().Set("ETag", a.etag())
+	w.Header().Set("Last-Modified", a.modTime.UTC().Format(http.TimeFormat))
+	w.Header().Set("Content-Type", contentType(a.path))
+	w.Header().Set("Vary", "Accept-Encoding")
+	if fingerprinted {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age=60")
+	}
+
+	body, encoding := a.negotiate(r.Header.Get("Accept-Encoding"))
+	if encoding != "" {
+		w.Header().Set("Content-Encoding", encoding)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	if r.Method != "HEAD" {
+		w.Write(body)
+	}
+}
+
+func (a *asset) negotiate(acceptEncoding string) (body []byte, encoding string) {
+	if strings.Contains(acceptEncoding, "br") && len(a.brotli) > 0 && len(a.brotli) < len(a.raw) {
+		return a.brotli, "br"
+	}
+	if strings.Contains(acceptEncoding, "gzip") && len(a.gzip) > 0 && len(a.gzip) < len(a.raw) {
+		return a.gzip, "gzip"
+	}
+	return a.raw, ""
+}
+
+func contentType(path string) string {
+	switch filepath.Ext(path) {
+	case ".css":
+		return "text/css; charset=utf-8"
+	case ".js":
+		return "application/javascript; charset=utf-8"
+	case ".svg":
+		return "image/svg+xml"
+	case ".png":
+		return "image/png"
+	case ".jpg", ".jpeg":
+		return "image/jpeg"
+	case ".gif":
+		return "image/gif"
+	case ".ico":
+		return "image/x-icon"
+	case ".woff2":
+		return "font/woff2"
+	default:
+		return "application/octet-stream"
+	}
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2014 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package staticfs
+
+import "testing"
+
+func TestFingerprintedName(t *testing.T) {
+	tests := []struct {
+		logicalPath, digest, want string
+	}{
+		{"css/site.css", "0123456789abcdef", "css/site.0123456789ab.css"},
+		{"favicon.ico", "deadbeefdeadbeef", "favicon.deadbeefdead.ico"},
+		{"noext", "0123456789abcdef", "noext.0123456789ab"},
+	}
+	for _, tt := range tests {
+		if got := fingerprintedName(tt.logicalPath, tt.digest); got != tt.want {
+			t.Errorf("fingerprintedName(%q, %q) = %q, want %q", tt.logicalPath, tt.digest, got, tt.want)
+		}
+	}
+}
+
+func TestAssetNegotiate(t *testing.T) {
+	a := &asset{
+		raw:    []byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"),
+		gzip:   []byte("gzipbytes"),
+		brotli: []byte("br"),
+	}
+	tests := []struct {
+		acceptEncoding string
+		wantBody       []byte
+		wantEncoding   string
+	}{
+		{"gzip, br", a.brotli, "br"},
+		{"gzip", a.gzip, "gzip"},
+		{"identity", a.raw, ""},
+		{"", a.raw, ""},
+	}
+	for _, tt := range tests {
+		body, encoding := a.negotiate(tt.acceptEncoding)
+		if string(body) != string(tt.wantBody) || encoding != tt.wantEncoding {
+			t.Errorf("negotiate(%q) = (%q, %q), want (%q, %q)", tt.acceptEncoding, body, encoding, tt.wantBody, tt.wantEncoding)
+		}
+	}
+}
+
+func TestAssetNegotiateSkipsLargerCompressedForm(t *testing.T) {
+	a := &asset{
+		raw:  []byte("x"),
+		gzip: []byte("much-bigger-than-the-raw-body"),
+	}
+	body, encoding := a.negotiate("gzip")
+	if encoding != "" || string(body) != string(a.raw) {
+		t.Errorf("negotiate(%q) = (%q, %q), want the raw body uncompressed", "gzip", body, encoding)
+	}
+}